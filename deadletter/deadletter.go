@@ -0,0 +1,370 @@
+// Package deadletter holds events that HTTPBulkProcessor gave up on, either
+// because a bulk response rejected them outright or because they exhausted
+// their retries, so operators can inspect what shipping silently dropped
+// until now. Every Sink is non-blocking: Write queues onto a small bounded
+// channel and counts a drop rather than ever blocking the main pipeline.
+package deadletter
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+const DEFAULT_QUEUE_SIZE = 10000
+
+// Record is what every Sink implementation persists for one dead-lettered
+// event.
+type Record struct {
+	Timestamp     int64  `json:"timestamp"`
+	Host          string `json:"host"`
+	StatusCode    int    `json:"status_code"`
+	Reason        string `json:"reason"`
+	OriginalEvent []byte `json:"original_event"`
+}
+
+// Sink accepts dead-lettered records. Write must never block the caller.
+type Sink interface {
+	Write(Record)
+	Dropped() int64
+	Close() error
+}
+
+// queue gives every Sink implementation a common non-blocking, bounded
+// buffered channel, a drop counter, and the done/wg pair run() uses to drain
+// ch before the sink tears down its backing resource on Close.
+type queue struct {
+	ch      chan Record
+	dropped int64
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+func newQueue(size int) queue {
+	if size <= 0 {
+		size = DEFAULT_QUEUE_SIZE
+	}
+	return queue{ch: make(chan Record, size), done: make(chan struct{})}
+}
+
+func (q *queue) push(rec Record) {
+	select {
+	case q.ch <- rec:
+	default:
+		atomic.AddInt64(&q.dropped, 1)
+	}
+}
+
+func (q *queue) Dropped() int64 {
+	return atomic.LoadInt64(&q.dropped)
+}
+
+// stop signals run() to exit and blocks until it has drained every record
+// still sitting in ch, so Close can tear down the backing resource (file,
+// HTTP client, producer) only once nothing is left to deliver.
+func (q *queue) stop() {
+	close(q.done)
+	q.wg.Wait()
+}
+
+// FileSink appends records as newline-delimited JSON to path, rotating to
+// path.<unix-ms> once maxSize or maxAge is exceeded.
+type FileSink struct {
+	queue
+
+	path    string
+	maxSize int64
+	maxAge  time.Duration
+
+	mux       sync.Mutex
+	file      *os.File
+	size      int64
+	createdAt time.Time
+}
+
+func NewFileSink(path string, maxSize int64, maxAge time.Duration, queueSize int) (*FileSink, error) {
+	s := &FileSink{
+		queue:   newQueue(queueSize),
+		path:    path,
+		maxSize: maxSize,
+		maxAge:  maxAge,
+	}
+
+	if err := s.openLocked(); err != nil {
+		return nil, err
+	}
+
+	s.wg.Add(1)
+	go s.run()
+	return s, nil
+}
+
+func (s *FileSink) openLocked() error {
+	if err := os.MkdirAll(filepath.Dir(s.path), 0755); err != nil {
+		return fmt.Errorf("create dead letter dir: %w", err)
+	}
+
+	f, err := os.OpenFile(s.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("open dead letter file %s: %w", s.path, err)
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	s.file = f
+	s.size = info.Size()
+	s.createdAt = time.Now()
+	return nil
+}
+
+func (s *FileSink) Write(rec Record) {
+	s.push(rec)
+}
+
+func (s *FileSink) run() {
+	defer s.wg.Done()
+	for {
+		select {
+		case rec := <-s.ch:
+			s.writeRecord(rec)
+		case <-s.done:
+			s.drain()
+			return
+		}
+	}
+}
+
+// drain flushes whatever is still buffered in ch without blocking, so Close
+// doesn't tear down the file out from under a record that was queued but not
+// yet written.
+func (s *FileSink) drain() {
+	for {
+		select {
+		case rec := <-s.ch:
+			s.writeRecord(rec)
+		default:
+			return
+		}
+	}
+}
+
+func (s *FileSink) writeRecord(rec Record) {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		glog.Errorf("dead letter marshal error: %s", err)
+		return
+	}
+	data = append(data, '\n')
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	if (s.maxSize > 0 && s.size+int64(len(data)) > s.maxSize) || (s.maxAge > 0 && time.Since(s.createdAt) > s.maxAge) {
+		s.rotateLocked()
+	}
+
+	n, err := s.file.Write(data)
+	if err != nil {
+		glog.Errorf("dead letter write error: %s", err)
+		return
+	}
+	s.size += int64(n)
+}
+
+func (s *FileSink) rotateLocked() {
+	s.file.Close()
+
+	rotated := fmt.Sprintf("%s.%d", s.path, time.Now().UnixNano()/int64(time.Millisecond))
+	if err := os.Rename(s.path, rotated); err != nil {
+		glog.Errorf("dead letter rotate error: %s", err)
+	}
+	if err := s.openLocked(); err != nil {
+		glog.Errorf("dead letter reopen error: %s", err)
+	}
+}
+
+func (s *FileSink) Close() error {
+	s.stop()
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return s.file.Close()
+}
+
+// HTTPSink batches records and POSTs them as a JSON array to url.
+type HTTPSink struct {
+	queue
+
+	url    string
+	client *http.Client
+}
+
+const (
+	httpSinkBatchSize     = 100
+	httpSinkFlushInterval = time.Second
+)
+
+func NewHTTPSink(url string, queueSize int) *HTTPSink {
+	s := &HTTPSink{
+		queue:  newQueue(queueSize),
+		url:    url,
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+
+	s.wg.Add(1)
+	go s.run()
+	return s
+}
+
+func (s *HTTPSink) Write(rec Record) {
+	s.push(rec)
+}
+
+func (s *HTTPSink) run() {
+	defer s.wg.Done()
+	ticker := time.NewTicker(httpSinkFlushInterval)
+	defer ticker.Stop()
+
+	batch := make([]Record, 0, httpSinkBatchSize)
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		s.post(batch)
+		batch = batch[:0]
+	}
+
+	for {
+		select {
+		case rec := <-s.ch:
+			batch = append(batch, rec)
+			if len(batch) >= httpSinkBatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		case <-s.done:
+			s.drainInto(&batch)
+			flush()
+			return
+		}
+	}
+}
+
+// drainInto appends whatever is still buffered in ch onto batch without
+// blocking, so Close doesn't drop the tail of the queue.
+func (s *HTTPSink) drainInto(batch *[]Record) {
+	for {
+		select {
+		case rec := <-s.ch:
+			*batch = append(*batch, rec)
+		default:
+			return
+		}
+	}
+}
+
+func (s *HTTPSink) post(batch []Record) {
+	data, err := json.Marshal(batch)
+	if err != nil {
+		glog.Errorf("dead letter marshal error: %s", err)
+		return
+	}
+
+	resp, err := s.client.Post(s.url, "application/json", bytes.NewReader(data))
+	if err != nil {
+		glog.Errorf("dead letter post to %s error: %s", s.url, err)
+		return
+	}
+	resp.Body.Close()
+}
+
+func (s *HTTPSink) Close() error {
+	s.stop()
+	return nil
+}
+
+// KafkaProducer is the minimal send capability KafkaSink needs. The kafka
+// output wires in its existing producer here so this package doesn't need
+// its own kafka client dependency.
+type KafkaProducer interface {
+	SendMessage(topic string, key, value []byte) error
+}
+
+// KafkaSink publishes each record as a JSON message to topic via producer.
+type KafkaSink struct {
+	queue
+
+	topic    string
+	producer KafkaProducer
+}
+
+func NewKafkaSink(topic string, producer KafkaProducer, queueSize int) *KafkaSink {
+	s := &KafkaSink{
+		queue:    newQueue(queueSize),
+		topic:    topic,
+		producer: producer,
+	}
+
+	s.wg.Add(1)
+	go s.run()
+	return s
+}
+
+func (s *KafkaSink) Write(rec Record) {
+	s.push(rec)
+}
+
+func (s *KafkaSink) send(rec Record) {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		glog.Errorf("dead letter marshal error: %s", err)
+		return
+	}
+	if err := s.producer.SendMessage(s.topic, nil, data); err != nil {
+		glog.Errorf("dead letter kafka send error: %s", err)
+	}
+}
+
+func (s *KafkaSink) run() {
+	defer s.wg.Done()
+	for {
+		select {
+		case rec := <-s.ch:
+			s.send(rec)
+		case <-s.done:
+			s.drain()
+			return
+		}
+	}
+}
+
+// drain sends whatever is still buffered in ch without blocking, so Close
+// doesn't drop the tail of the queue.
+func (s *KafkaSink) drain() {
+	for {
+		select {
+		case rec := <-s.ch:
+			s.send(rec)
+		default:
+			return
+		}
+	}
+}
+
+func (s *KafkaSink) Close() error {
+	s.stop()
+	return nil
+}
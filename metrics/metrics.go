@@ -0,0 +1,94 @@
+// Package metrics holds the Prometheus collectors for output.HTTPBulkProcessor
+// and an optional HTTP listener to expose them. Recording is opt-in: a
+// processor only touches these collectors when its metrics.listen option is
+// set, so there is no overhead for outputs that don't configure it.
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	BulkEventsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "gohangout_bulk_events_total",
+		Help: "Total events handled by the bulk processor, by outcome (success, retry, drop).",
+	}, []string{"outcome"})
+
+	BulkBytesTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "gohangout_bulk_bytes_total",
+		Help: "Total bytes sent in bulk request bodies.",
+	})
+
+	BulkDurationSeconds = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name: "gohangout_bulk_duration_seconds",
+		Help: "Bulk request duration in seconds, per top-level execution.",
+	})
+
+	BulkInflight = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "gohangout_bulk_inflight",
+		Help: "Number of bulk requests currently in flight.",
+	})
+
+	BulkQueueEvents = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "gohangout_bulk_queue_events",
+		Help: "Number of events currently buffered in the not-yet-flushed BulkRequest.",
+	})
+
+	HostUp = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "gohangout_host_up",
+		Help: "1 if the host's selection weight is above zero, else 0.",
+	}, []string{"host"})
+
+	HostFailuresTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "gohangout_host_failures_total",
+		Help: "Total bulk request failures, by host.",
+	}, []string{"host"})
+
+	RetriesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "gohangout_retries_total",
+		Help: "Total retried bulk responses, by response code.",
+	}, []string{"code"})
+
+	DeadLetterDroppedTotal = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "gohangout_dead_letter_dropped_total",
+		Help: "Records dropped by the dead letter sink because its queue was full.",
+	})
+
+	WALUnackedBytes = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "gohangout_wal_unacked_bytes",
+		Help: "Bytes of WAL records appended but not yet acked, for alarming when downstream is lagging.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(
+		BulkEventsTotal,
+		BulkBytesTotal,
+		BulkDurationSeconds,
+		BulkInflight,
+		BulkQueueEvents,
+		HostUp,
+		HostFailuresTotal,
+		RetriesTotal,
+		DeadLetterDroppedTotal,
+		WALUnackedBytes,
+	)
+}
+
+// Listen starts an HTTP server exposing /metrics on addr in the background.
+// Callers should only invoke it once per addr; it is meant to be gated by an
+// opt-in output config option (metrics.listen).
+func Listen(addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+
+	go func() {
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			glog.Errorf("metrics listener on %s stopped: %s", addr, err)
+		}
+	}()
+}
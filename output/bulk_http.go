@@ -4,16 +4,24 @@ import (
 	"bytes"
 	"compress/gzip"
 	"context"
+	"errors"
+	"io"
 	"io/ioutil"
+	"math"
 	"math/rand"
 	"net/http"
 	"regexp"
+	"strconv"
 	"sync"
 	"time"
 
 	"golang.org/x/sync/semaphore"
 
 	"github.com/golang/glog"
+
+	"github.com/yuan-make/gohangout/deadletter"
+	"github.com/yuan-make/gohangout/metrics"
+	"github.com/yuan-make/gohangout/wal"
 )
 
 const (
@@ -23,16 +31,35 @@ const (
 	DEFAULT_CONCURRENT     = 1
 
 	MAX_BYTE_SIZE_APPLIED_IN_ADVANCE = 1024 * 1024 * 50
+
+	DEFAULT_RETRY_INITIAL_BACKOFF_MS = 500
+	DEFAULT_RETRY_MAX_BACKOFF_MS     = 30 * 1000
 )
 
 var (
 	REMOVE_HTTP_AUTH_REGEXP = regexp.MustCompile(`^(?i)(http(s?)://)[^:]+:[^@]+@`)
+	errBulkFailed           = errors.New("bulk request failed")
 )
 
 type HostSelector interface {
-	selectOneHost() string
+	// selectOneHost returns a host for the given routing key. An empty key
+	// means the caller has no affinity requirement and the selector should
+	// fall back to its default strategy (e.g. round-robin).
+	selectOneHost(key string) string
 	reduceWeight(string)
 	addWeight(string)
+
+	// markFailure/markSuccess feed the per-host circuit breaker, independent
+	// of reduceWeight/addWeight. minCooldownRemaining lets callers avoid a
+	// fixed sleep when every host is currently open.
+	markFailure(host string, err error)
+	markSuccess(host string)
+	minCooldownRemaining() time.Duration
+
+	// isUp reports the selector's own up/down judgement of host, i.e. whether
+	// its selection weight is still above zero, rather than the outcome of
+	// whichever single bulk attempt the caller just made.
+	isUp(host string) bool
 }
 
 type RRHostSelector struct {
@@ -41,9 +68,10 @@ type RRHostSelector struct {
 	weight     []int
 	index      int
 	hostsCount int
+	cb         *CircuitBreaker
 }
 
-func NewRRHostSelector(hosts []string, weight int) *RRHostSelector {
+func NewRRHostSelector(hosts []string, weight int, cbFailureThreshold float64, cbCooldown time.Duration) *RRHostSelector {
 	rand.Seed(time.Now().UnixNano())
 	hostsCount := len(hosts)
 	rst := &RRHostSelector{
@@ -51,6 +79,7 @@ func NewRRHostSelector(hosts []string, weight int) *RRHostSelector {
 		index:      int(rand.Int31n(int32(hostsCount))),
 		hostsCount: hostsCount,
 		initWeight: weight,
+		cb:         NewCircuitBreaker(hosts, cbFailureThreshold, cbCooldown),
 	}
 	rst.weight = make([]int, hostsCount)
 	for i := 0; i < hostsCount; i++ {
@@ -60,21 +89,40 @@ func NewRRHostSelector(hosts []string, weight int) *RRHostSelector {
 	return rst
 }
 
-func (s *RRHostSelector) selectOneHost() string {
-	// reset weight and return "" if all hosts are down
-	var hasAtLeastOneUp bool = false
+func (s *RRHostSelector) selectOneHost(key string) string {
 	for i := 0; i < s.hostsCount; i++ {
-		if s.weight[i] > 0 {
-			hasAtLeastOneUp = true
+		idx := (s.index + 1 + i) % s.hostsCount
+		host := s.hosts[idx]
+		if s.weight[idx] > 0 && s.cb.Allow(host) {
+			s.index = idx
+			return host
 		}
 	}
-	if !hasAtLeastOneUp {
-		s.resetWeight(s.initWeight)
-		return ""
-	}
 
-	s.index = (s.index + 1) % s.hostsCount
-	return s.hosts[s.index]
+	// reset weight if all hosts are down or every breaker is open
+	s.resetWeight(s.initWeight)
+	return ""
+}
+
+func (s *RRHostSelector) markFailure(host string, err error) {
+	s.cb.RecordFailure(host)
+}
+
+func (s *RRHostSelector) markSuccess(host string) {
+	s.cb.RecordSuccess(host)
+}
+
+func (s *RRHostSelector) minCooldownRemaining() time.Duration {
+	return s.cb.MinCooldownRemaining()
+}
+
+func (s *RRHostSelector) isUp(host string) bool {
+	for i, h := range s.hosts {
+		if host == h {
+			return s.weight[i] > 0
+		}
+	}
+	return false
 }
 
 func (s *RRHostSelector) resetWeight(weight int) {
@@ -107,6 +155,18 @@ func (s *RRHostSelector) addWeight(host string) {
 	}
 }
 
+const HOST_SELECTOR_CONSISTENT_HASH = "consistent_hash"
+
+// newHostSelector builds the HostSelector configured by the host_selector
+// output option. An unrecognized or empty value keeps the historical
+// round-robin behavior.
+func newHostSelector(host_selector string, hosts []string, cbFailureThreshold float64, cbCooldown time.Duration) HostSelector {
+	if host_selector == HOST_SELECTOR_CONSISTENT_HASH {
+		return NewConsistentHashSelector(hosts, DEFAULT_VIRTUAL_NODE_COUNT, cbFailureThreshold, cbCooldown)
+	}
+	return NewRRHostSelector(hosts, 3, cbFailureThreshold, cbCooldown)
+}
+
 type Event interface {
 	Encode() []byte
 }
@@ -119,6 +179,45 @@ type BulkRequest interface {
 }
 type NewBulkRequestFunc func() BulkRequest
 
+// RoutingKeyBulkRequest is an optional extension of BulkRequest. A
+// BulkRequest implementation that can name a key to route itself by (e.g.
+// the target index of its first event) should implement it; HostSelectors
+// that support key affinity (ConsistentHashSelector) will use it, and
+// HostSelectors that don't (RRHostSelector) simply ignore it.
+type RoutingKeyBulkRequest interface {
+	BulkRequest
+	routingKey() string
+}
+
+func bulkRequestRoutingKey(br BulkRequest) string {
+	if rkbr, ok := br.(RoutingKeyBulkRequest); ok {
+		return rkbr.routingKey()
+	}
+	return ""
+}
+
+// DeadLetterBulkRequest is an optional extension of BulkRequest for the
+// dead_letter output option. A BulkRequest implementation that can resolve
+// an index back to its original encoded event, and explain why a bulk
+// response rejected it, should implement it so innerBulk/tryOneBulk can
+// write those events to the configured DeadLetter sink instead of only
+// logging and discarding them.
+type DeadLetterBulkRequest interface {
+	BulkRequest
+	eventAt(i int) []byte
+	rejectReasonAt(i int, respBody []byte) string
+}
+
+// StreamableBulkRequest is an optional extension of BulkRequest for the
+// stream output option. Implementing it lets tryOneBulk pipe the bulk body
+// straight into the HTTP request via io.Pipe instead of materializing a
+// second, gzip-compressed copy of the whole batch in memory.
+type StreamableBulkRequest interface {
+	WriteTo(io.Writer) (int64, error)
+	eventCount() int
+	bufSizeByte() int
+}
+
 type BulkProcessor interface {
 	add(Event)
 	bulk(BulkRequest, int)
@@ -127,6 +226,10 @@ type BulkProcessor interface {
 
 type GetRetryEventsFunc func(*http.Response, []byte, BulkRequest) ([]int, []int, BulkRequest)
 
+// DecodeEventFunc turns a raw WAL record back into an Event so it can be fed
+// back through add() during crash recovery. It is the inverse of Event.Encode.
+type DecodeEventFunc func([]byte) Event
+
 type HTTPBulkProcessor struct {
 	headers           map[string]string
 	requestMethod     string
@@ -142,30 +245,154 @@ type HTTPBulkProcessor struct {
 	wg                sync.WaitGroup
 	semaphore         *semaphore.Weighted
 
+	stream                bool
+	stream_flush_events   int
+	stream_all_or_nothing bool
+
+	wal        *wal.WAL
+	walRecords []wal.Record
+
+	max_retries              int
+	retry_initial_backoff_ms int
+	retry_max_backoff_ms     int
+	retry_jitter             float64
+	execution_deadline       time.Duration
+
+	metrics_enabled bool
+
 	hostSelector       HostSelector
 	bulkRequest        BulkRequest
 	newBulkRequestFunc NewBulkRequestFunc
 	getRetryEventsFunc GetRetryEventsFunc
+
+	// deadLetter is nil unless the dead_letter output option configured a
+	// sink; writeDeadLetter is then a no-op guard rather than every call site
+	// having to check it.
+	deadLetter deadletter.Sink
+}
+
+// HTTPBulkProcessorConfig collects every NewHTTPBulkProcessor option. It grew
+// past two dozen positional parameters of overlapping types across several
+// features (streaming, WAL, retries, metrics, dead letter), so it is
+// collected into a struct rather than bolting on yet another positional
+// argument.
+type HTTPBulkProcessorConfig struct {
+	Headers           map[string]string
+	Hosts             []string
+	RequestMethod     string
+	RetryResponseCode map[int]bool
+	Bulk_size         int
+	Bulk_actions      int
+	Flush_interval    int
+	Concurrent        int
+	Compress          bool
+
+	Host_selector        string
+	Cb_failure_threshold float64
+	Cb_cooldown          time.Duration
+
+	Stream                bool
+	Stream_flush_events   int
+	Stream_all_or_nothing bool
+
+	Wal_dir            string
+	Wal_max_size       int64
+	Wal_fsync          string
+	Wal_fsync_interval time.Duration
+	DecodeEventFunc    DecodeEventFunc
+
+	Max_retries              int
+	Retry_initial_backoff_ms int
+	Retry_max_backoff_ms     int
+	Retry_jitter             float64
+	Execution_deadline       time.Duration
+
+	Metrics_listen string
+	DeadLetter     deadletter.Sink
+
+	NewBulkRequestFunc NewBulkRequestFunc
+	GetRetryEventsFunc GetRetryEventsFunc
 }
 
-func NewHTTPBulkProcessor(headers map[string]string, hosts []string, requestMethod string, retryResponseCode map[int]bool, bulk_size, bulk_actions, flush_interval, concurrent int, compress bool, newBulkRequestFunc NewBulkRequestFunc, getRetryEventsFunc GetRetryEventsFunc) *HTTPBulkProcessor {
+func NewHTTPBulkProcessor(config HTTPBulkProcessorConfig) *HTTPBulkProcessor {
+	headers := config.Headers
+	hosts := config.Hosts
+	requestMethod := config.RequestMethod
+	retryResponseCode := config.RetryResponseCode
+	bulk_size := config.Bulk_size
+	bulk_actions := config.Bulk_actions
+	flush_interval := config.Flush_interval
+	concurrent := config.Concurrent
+	compress := config.Compress
+	host_selector := config.Host_selector
+	cb_failure_threshold := config.Cb_failure_threshold
+	cb_cooldown := config.Cb_cooldown
+	stream := config.Stream
+	stream_flush_events := config.Stream_flush_events
+	stream_all_or_nothing := config.Stream_all_or_nothing
+	wal_dir := config.Wal_dir
+	wal_max_size := config.Wal_max_size
+	wal_fsync := config.Wal_fsync
+	wal_fsync_interval := config.Wal_fsync_interval
+	decodeEventFunc := config.DecodeEventFunc
+	max_retries := config.Max_retries
+	retry_initial_backoff_ms := config.Retry_initial_backoff_ms
+	retry_max_backoff_ms := config.Retry_max_backoff_ms
+	retry_jitter := config.Retry_jitter
+	execution_deadline := config.Execution_deadline
+	metrics_listen := config.Metrics_listen
+	deadLetter := config.DeadLetter
+	newBulkRequestFunc := config.NewBulkRequestFunc
+	getRetryEventsFunc := config.GetRetryEventsFunc
+
 	bulkProcessor := &HTTPBulkProcessor{
-		headers:            headers,
-		requestMethod:      requestMethod,
-		retryResponseCode:  retryResponseCode,
-		bulk_size:          bulk_size,
-		bulk_actions:       bulk_actions,
-		flush_interval:     flush_interval,
-		client:             &http.Client{},
-		hostSelector:       NewRRHostSelector(hosts, 3),
-		concurrent:         concurrent,
-		compress:           compress,
-		bulkRequest:        newBulkRequestFunc(),
-		newBulkRequestFunc: newBulkRequestFunc,
-		getRetryEventsFunc: getRetryEventsFunc,
+		headers:                  headers,
+		requestMethod:            requestMethod,
+		retryResponseCode:        retryResponseCode,
+		bulk_size:                bulk_size,
+		bulk_actions:             bulk_actions,
+		flush_interval:           flush_interval,
+		client:                   &http.Client{},
+		hostSelector:             newHostSelector(host_selector, hosts, cb_failure_threshold, cb_cooldown),
+		concurrent:               concurrent,
+		compress:                 compress,
+		stream:                   stream,
+		stream_flush_events:      stream_flush_events,
+		stream_all_or_nothing:    stream_all_or_nothing,
+		max_retries:              max_retries,
+		retry_initial_backoff_ms: retry_initial_backoff_ms,
+		retry_max_backoff_ms:     retry_max_backoff_ms,
+		retry_jitter:             retry_jitter,
+		execution_deadline:       execution_deadline,
+		metrics_enabled:          metrics_listen != "",
+		deadLetter:               deadLetter,
+		bulkRequest:              newBulkRequestFunc(),
+		newBulkRequestFunc:       newBulkRequestFunc,
+		getRetryEventsFunc:       getRetryEventsFunc,
 	}
 	bulkProcessor.semaphore = semaphore.NewWeighted(int64(concurrent))
 
+	if metrics_listen != "" {
+		metrics.Listen(metrics_listen)
+	}
+
+	if wal_dir != "" {
+		w, err := wal.Open(wal_dir, wal_max_size, wal.ParseFsyncPolicy(wal_fsync), wal_fsync_interval)
+		if err != nil {
+			glog.Errorf("open wal at %s error: %s, wal disabled", wal_dir, err)
+		} else {
+			bulkProcessor.wal = w
+			if decodeEventFunc != nil {
+				if err := w.Replay(func(data []byte) error {
+					bulkProcessor.add(decodeEventFunc(data))
+					return nil
+				}); err != nil {
+					glog.Errorf("replay wal at %s error: %s", wal_dir, err)
+				}
+			}
+		}
+	}
+
 	ticker := time.NewTicker(time.Second * time.Duration(flush_interval))
 	go func() {
 		for range ticker.C {
@@ -178,10 +405,12 @@ func NewHTTPBulkProcessor(headers map[string]string, hosts []string, requestMeth
 			}
 			bulkRequest := bulkProcessor.bulkRequest
 			bulkProcessor.bulkRequest = newBulkRequestFunc()
+			records := bulkProcessor.walRecords
+			bulkProcessor.walRecords = nil
 			bulkProcessor.execution_id++
 			execution_id := bulkProcessor.execution_id
 			bulkProcessor.mux.Unlock()
-			bulkProcessor.bulk(bulkRequest, execution_id)
+			bulkProcessor.bulk(bulkRequest, execution_id, records)
 		}
 	}()
 
@@ -189,10 +418,34 @@ func NewHTTPBulkProcessor(headers map[string]string, hosts []string, requestMeth
 }
 
 func (p *HTTPBulkProcessor) add(event Event) {
+	var record wal.Record
+	if p.wal != nil {
+		var err error
+		record, err = p.wal.Append(event.Encode())
+		if err != nil {
+			glog.Errorf("wal append error: %s", err)
+		}
+	}
+
 	p.bulkRequest.add(event)
+	if p.wal != nil {
+		p.walRecords = append(p.walRecords, record)
+	}
+
+	if p.metrics_enabled {
+		metrics.BulkQueueEvents.Set(float64(p.bulkRequest.eventCount()))
+		if p.wal != nil {
+			metrics.WALUnackedBytes.Set(float64(p.wal.UnackedBytes()))
+		}
+	}
+
+	bulk_actions := p.bulk_actions
+	if p.stream && p.stream_flush_events > 0 && p.stream_flush_events < bulk_actions {
+		bulk_actions = p.stream_flush_events
+	}
 
 	// TODO bulkRequest passed to bulk may be empty, but execution_id has ++
-	if p.bulkRequest.bufSizeByte() >= p.bulk_size || p.bulkRequest.eventCount() >= p.bulk_actions {
+	if p.bulkRequest.bufSizeByte() >= p.bulk_size || p.bulkRequest.eventCount() >= bulk_actions {
 		p.semaphore.Acquire(context.TODO(), 1)
 		p.mux.Lock()
 		if p.bulkRequest.eventCount() == 0 {
@@ -202,10 +455,52 @@ func (p *HTTPBulkProcessor) add(event Event) {
 		}
 		bulkRequest := p.bulkRequest
 		p.bulkRequest = p.newBulkRequestFunc()
+		records := p.walRecords
+		p.walRecords = nil
 		p.execution_id++
 		execution_id := p.execution_id
 		p.mux.Unlock()
-		go p.bulk(bulkRequest, execution_id)
+		go p.bulk(bulkRequest, execution_id, records)
+	}
+}
+
+func (p *HTTPBulkProcessor) ackWAL(records []wal.Record) {
+	if p.wal == nil || len(records) == 0 {
+		return
+	}
+	if err := p.wal.Ack(records); err != nil {
+		glog.Errorf("wal ack error: %s", err)
+	}
+	if p.metrics_enabled {
+		metrics.WALUnackedBytes.Set(float64(p.wal.UnackedBytes()))
+	}
+}
+
+// writeDeadLetter sends the events at indices to the configured dead letter
+// sink, resolving each back to its original encoded form and a rejection
+// reason via DeadLetterBulkRequest. It is a no-op if no sink is configured or
+// br doesn't implement DeadLetterBulkRequest.
+func (p *HTTPBulkProcessor) writeDeadLetter(br BulkRequest, indices []int, host string, statusCode int, respBody []byte) {
+	if p.deadLetter == nil || len(indices) == 0 {
+		return
+	}
+	dlbr, ok := br.(DeadLetterBulkRequest)
+	if !ok {
+		return
+	}
+
+	for _, i := range indices {
+		p.deadLetter.Write(deadletter.Record{
+			Timestamp:     time.Now().Unix(),
+			Host:          REMOVE_HTTP_AUTH_REGEXP.ReplaceAllString(host, "${1}"),
+			StatusCode:    statusCode,
+			Reason:        dlbr.rejectReasonAt(i, respBody),
+			OriginalEvent: dlbr.eventAt(i),
+		})
+	}
+
+	if p.metrics_enabled {
+		metrics.DeadLetterDroppedTotal.Set(float64(p.deadLetter.Dropped()))
 	}
 }
 
@@ -236,51 +531,130 @@ func (p *HTTPBulkProcessor) awaitclose(timeout time.Duration) {
 	}
 	bulkRequest := p.bulkRequest
 	p.bulkRequest = p.newBulkRequestFunc()
+	records := p.walRecords
+	p.walRecords = nil
 	p.execution_id++
 	execution_id := p.execution_id
 	p.mux.Unlock()
 
 	p.wg.Add(1)
 	go func() {
-		p.innerBulk(bulkRequest, execution_id)
+		p.innerBulk(bulkRequest, execution_id, records)
 		p.wg.Done()
 	}()
 }
 
-func (p *HTTPBulkProcessor) bulk(bulkRequest BulkRequest, execution_id int) {
+func (p *HTTPBulkProcessor) bulk(bulkRequest BulkRequest, execution_id int, records []wal.Record) {
 	defer p.wg.Done()
 	defer p.semaphore.Release(1)
 	p.wg.Add(1)
 	if bulkRequest.eventCount() == 0 {
 		return
 	}
-	p.innerBulk(bulkRequest, execution_id)
+	p.innerBulk(bulkRequest, execution_id, records)
+}
+
+func (p *HTTPBulkProcessor) innerBulk(bulkRequest BulkRequest, execution_id int, records []wal.Record) {
+	p.innerBulkWithDeadline(bulkRequest, execution_id, records, time.Now(), 0)
 }
 
-func (p *HTTPBulkProcessor) innerBulk(bulkRequest BulkRequest, execution_id int) {
+// backoffDuration computes the exponential-backoff-with-jitter wait before
+// retry number attempt: min(max, initial*2^attempt) * (1 +/- jitter).
+func (p *HTTPBulkProcessor) backoffDuration(attempt int) time.Duration {
+	initial := p.retry_initial_backoff_ms
+	if initial <= 0 {
+		initial = DEFAULT_RETRY_INITIAL_BACKOFF_MS
+	}
+	maxBackoff := p.retry_max_backoff_ms
+	if maxBackoff <= 0 {
+		maxBackoff = DEFAULT_RETRY_MAX_BACKOFF_MS
+	}
+
+	backoff := float64(initial) * math.Pow(2, float64(attempt))
+	if backoff > float64(maxBackoff) {
+		backoff = float64(maxBackoff)
+	}
+
+	if p.retry_jitter > 0 {
+		backoff *= 1 + (rand.Float64()*2-1)*p.retry_jitter
+		if backoff < 0 {
+			backoff = 0
+		}
+	}
+
+	return time.Duration(backoff) * time.Millisecond
+}
+
+func (p *HTTPBulkProcessor) innerBulkWithDeadline(bulkRequest BulkRequest, execution_id int, records []wal.Record, startedAt time.Time, attempt int) {
 	_startTime := float64(time.Now().UnixNano()/1000000) / 1000
 	eventCount := bulkRequest.eventCount()
 	glog.Infof("bulk %d docs with execution_id %d", eventCount, execution_id)
+	key := bulkRequestRoutingKey(bulkRequest)
+
 	for {
-		host := p.hostSelector.selectOneHost()
+		if p.execution_deadline > 0 && time.Since(startedAt) > p.execution_deadline {
+			glog.Errorf("execution_id %d exceeded execution_deadline, dropping %d events", execution_id, eventCount)
+			if p.metrics_enabled {
+				metrics.BulkEventsTotal.WithLabelValues("drop").Add(float64(eventCount))
+			}
+			p.writeDeadLetter(bulkRequest, allIndices(eventCount), "", 0, []byte("execution_deadline exceeded"))
+			p.ackWAL(records)
+			return
+		}
+		if p.max_retries > 0 && attempt > p.max_retries {
+			glog.Errorf("execution_id %d exceeded max_retries(%d), dropping %d events", execution_id, p.max_retries, eventCount)
+			if p.metrics_enabled {
+				metrics.BulkEventsTotal.WithLabelValues("drop").Add(float64(eventCount))
+			}
+			p.writeDeadLetter(bulkRequest, allIndices(eventCount), "", 0, []byte("max_retries exceeded"))
+			p.ackWAL(records)
+			return
+		}
+
+		host := p.hostSelector.selectOneHost(key)
 		if host == "" {
-			glog.Info("no available host, wait for 30s")
-			time.Sleep(30 * time.Second)
+			wait := p.hostSelector.minCooldownRemaining()
+			if wait <= 0 {
+				wait = p.backoffDuration(attempt)
+			}
+			glog.Infof("no available host, wait for %s", wait)
+			time.Sleep(wait)
+			attempt++
 			continue
 		}
 
 		glog.Infof("try to bulk with host (%s)", REMOVE_HTTP_AUTH_REGEXP.ReplaceAllString(host, "${1}"))
 
+		if p.metrics_enabled {
+			metrics.BulkInflight.Inc()
+		}
 		url := host
 		success, shouldRetry, noRetry, newBulkRequest := p.tryOneBulk(url, bulkRequest)
+		if p.metrics_enabled {
+			metrics.BulkInflight.Dec()
+		}
+
+		sanitizedHost := REMOVE_HTTP_AUTH_REGEXP.ReplaceAllString(host, "${1}")
 		if success {
 			_finishTime := float64(time.Now().UnixNano()/1000000) / 1000
 			timeTaken := _finishTime - _startTime
 			glog.Infof("bulk done with execution_id %d %.3f %d %.3f", execution_id, timeTaken, eventCount, float64(eventCount)/timeTaken)
 			p.hostSelector.addWeight(host)
+			p.hostSelector.markSuccess(host)
+			if p.metrics_enabled {
+				metrics.BulkDurationSeconds.Observe(timeTaken)
+				metrics.HostUp.WithLabelValues(sanitizedHost).Set(boolToFloat(p.hostSelector.isUp(host)))
+			}
 		} else {
 			glog.Errorf("bulk failed with %s", url)
 			p.hostSelector.reduceWeight(host)
+			p.hostSelector.markFailure(host, errBulkFailed)
+			if p.metrics_enabled {
+				metrics.HostFailuresTotal.WithLabelValues(sanitizedHost).Inc()
+				metrics.HostUp.WithLabelValues(sanitizedHost).Set(boolToFloat(p.hostSelector.isUp(host)))
+			}
+			time.Sleep(p.backoffDuration(attempt))
+			attempt++
 			continue
 		}
 
@@ -288,22 +662,61 @@ func (p *HTTPBulkProcessor) innerBulk(bulkRequest BulkRequest, execution_id int)
 			glog.Infof("%d should retry; %d need not retry", len(shouldRetry), len(noRetry))
 		}
 
+		if p.metrics_enabled {
+			metrics.BulkEventsTotal.WithLabelValues("retry").Add(float64(len(shouldRetry)))
+			metrics.BulkEventsTotal.WithLabelValues("drop").Add(float64(len(noRetry)))
+			metrics.BulkEventsTotal.WithLabelValues("success").Add(float64(eventCount - len(shouldRetry) - len(noRetry)))
+		}
+
 		if len(shouldRetry) > 0 {
 			p.mux.Lock()
 			p.execution_id++
 			execution_id := p.execution_id
 			p.mux.Unlock()
-			p.innerBulk(newBulkRequest, execution_id)
+			time.Sleep(p.backoffDuration(attempt))
+			// records covers every event in the original batch, retried ones
+			// included, so it is only acked once this recursive chain
+			// finally resolves with nothing left to retry.
+			p.innerBulkWithDeadline(newBulkRequest, execution_id, records, startedAt, attempt+1)
+			return
 		}
 
+		p.ackWAL(records)
 		return // only success will go to here
 	}
 }
 
+// allIndices returns [0, n).
+func allIndices(n int) []int {
+	indices := make([]int, n)
+	for i := range indices {
+		indices[i] = i
+	}
+	return indices
+}
+
+func boolToFloat(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
 func (p *HTTPBulkProcessor) tryOneBulk(url string, br BulkRequest) (bool, []int, []int, BulkRequest) {
+	if p.stream {
+		if sbr, ok := br.(StreamableBulkRequest); ok {
+			return p.tryOneBulkStream(url, sbr, br)
+		}
+		glog.Warningf("stream is enabled but BulkRequest does not implement StreamableBulkRequest, falling back to buffered mode")
+	}
+
 	glog.V(5).Infof("request size:%d", br.bufSizeByte())
 	glog.V(20).Infof("%s", br.readBuf())
 
+	if p.metrics_enabled {
+		metrics.BulkBytesTotal.Add(float64(br.bufSizeByte()))
+	}
+
 	var (
 		shouldRetry    = make([]int, 0)
 		noRetry        = make([]int, 0)
@@ -348,6 +761,9 @@ func (p *HTTPBulkProcessor) tryOneBulk(url string, br BulkRequest) (bool, []int,
 	defer resp.Body.Close()
 
 	if p.retryResponseCode[resp.StatusCode] {
+		if p.metrics_enabled {
+			metrics.RetriesTotal.WithLabelValues(strconv.Itoa(resp.StatusCode)).Inc()
+		}
 		return false, shouldRetry, noRetry, nil
 	}
 
@@ -360,6 +776,91 @@ func (p *HTTPBulkProcessor) tryOneBulk(url string, br BulkRequest) (bool, []int,
 	glog.V(20).Infof("%s", respBody)
 
 	shouldRetry, noRetry, newBulkRequest = p.getRetryEventsFunc(resp, respBody, br)
+	p.writeDeadLetter(br, noRetry, url, resp.StatusCode, respBody)
+
+	return true, shouldRetry, noRetry, newBulkRequest
+}
+
+// tryOneBulkStream pipes sbr directly into the HTTP request body via
+// io.Pipe, so the compressed copy of the batch never has to sit fully
+// buffered in memory alongside the original. With stream_all_or_nothing set,
+// the response is not inspected per event: a 2xx status counts the whole bulk
+// as delivered and any other status fails it, so it is retried wholesale.
+// Without it, the response goes through getRetryEventsFunc against br, which
+// splits it into shouldRetry/noRetry by index as in buffered mode.
+func (p *HTTPBulkProcessor) tryOneBulkStream(url string, sbr StreamableBulkRequest, br BulkRequest) (bool, []int, []int, BulkRequest) {
+	glog.V(5).Infof("stream request size:%d", sbr.bufSizeByte())
+
+	if p.metrics_enabled {
+		metrics.BulkBytesTotal.Add(float64(sbr.bufSizeByte()))
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		var w io.Writer = pw
+		var gz *gzip.Writer
+		if p.compress {
+			gz = gzip.NewWriter(pw)
+			w = gz
+		}
+
+		if _, err := sbr.WriteTo(w); err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+		if gz != nil {
+			if err := gz.Close(); err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+		}
+		pw.Close()
+	}()
+
+	req, err := http.NewRequest(p.requestMethod, url, pr)
+	if err != nil {
+		glog.Errorf("create stream request error: %s", err)
+		return false, nil, nil, nil
+	}
+	req.ContentLength = -1 // unknown length: send chunked
+	if p.compress {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+
+	for k, v := range p.headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		glog.Infof("stream request with %s error: %s", url, err)
+		return false, nil, nil, nil
+	}
+	defer resp.Body.Close()
+
+	if p.retryResponseCode[resp.StatusCode] {
+		if p.metrics_enabled {
+			metrics.RetriesTotal.WithLabelValues(strconv.Itoa(resp.StatusCode)).Inc()
+		}
+		return false, nil, nil, nil
+	}
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		glog.Errorf(`read bulk response error: %s. will NOT retry`, err)
+		return true, nil, nil, nil
+	}
+	glog.V(5).Infof("get response[%d]", len(respBody))
+
+	if p.stream_all_or_nothing {
+		if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+			return true, nil, nil, nil
+		}
+		glog.Errorf("stream bulk rejected with status %d, retrying all-or-nothing", resp.StatusCode)
+		return false, nil, nil, nil
+	}
 
+	shouldRetry, noRetry, newBulkRequest := p.getRetryEventsFunc(resp, respBody, br)
+	p.writeDeadLetter(br, noRetry, url, resp.StatusCode, respBody)
 	return true, shouldRetry, noRetry, newBulkRequest
 }
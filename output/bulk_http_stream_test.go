@@ -0,0 +1,172 @@
+package output
+
+import (
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// testStreamBulkRequest is a minimal StreamableBulkRequest/BulkRequest double
+// that writes data in two chunks, optionally failing partway through
+// WriteTo, so tests can exercise tryOneBulkStream's pipe/gzip goroutine
+// without a real BulkRequest implementation.
+type testStreamBulkRequest struct {
+	data     []byte
+	writeErr error
+}
+
+func (t *testStreamBulkRequest) add(Event)        {}
+func (t *testStreamBulkRequest) bufSizeByte() int { return len(t.data) }
+func (t *testStreamBulkRequest) eventCount() int  { return 1 }
+func (t *testStreamBulkRequest) readBuf() []byte  { return t.data }
+func (t *testStreamBulkRequest) WriteTo(w io.Writer) (int64, error) {
+	mid := len(t.data) / 2
+	n1, err := w.Write(t.data[:mid])
+	if err != nil {
+		return int64(n1), err
+	}
+	if t.writeErr != nil {
+		return int64(n1), t.writeErr
+	}
+	n2, err := w.Write(t.data[mid:])
+	return int64(n1 + n2), err
+}
+
+func newTestStreamProcessor(streamAllOrNothing bool) *HTTPBulkProcessor {
+	return &HTTPBulkProcessor{
+		requestMethod:         "POST",
+		retryResponseCode:     map[int]bool{},
+		client:                &http.Client{},
+		stream:                true,
+		stream_all_or_nothing: streamAllOrNothing,
+		getRetryEventsFunc: func(resp *http.Response, respBody []byte, br BulkRequest) ([]int, []int, BulkRequest) {
+			return []int{1}, []int{2}, &testStreamBulkRequest{data: []byte(`retry`)}
+		},
+	}
+}
+
+func TestTryOneBulkStreamAllOrNothingSuccess(t *testing.T) {
+	var received []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var err error
+		received, err = ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Errorf("server read body: %s", err)
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	p := newTestStreamProcessor(true)
+	sbr := &testStreamBulkRequest{data: []byte(`{"index":{}}` + "\n" + `{"field":"value"}` + "\n")}
+
+	success, shouldRetry, noRetry, newBulkRequest := p.tryOneBulkStream(server.URL, sbr, sbr)
+	if !success {
+		t.Fatalf("expected success")
+	}
+	if shouldRetry != nil || noRetry != nil || newBulkRequest != nil {
+		t.Fatalf("all-or-nothing success should not report per-event retry info, got %v %v %v", shouldRetry, noRetry, newBulkRequest)
+	}
+	if string(received) != string(sbr.data) {
+		t.Fatalf("server received %q, want %q", received, sbr.data)
+	}
+}
+
+func TestTryOneBulkStreamAllOrNothingFailure(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	p := newTestStreamProcessor(true)
+	sbr := &testStreamBulkRequest{data: []byte(`{"index":{}}` + "\n")}
+
+	success, shouldRetry, noRetry, newBulkRequest := p.tryOneBulkStream(server.URL, sbr, sbr)
+	if success {
+		t.Fatalf("expected failure on a non-2xx status with all-or-nothing")
+	}
+	if shouldRetry != nil || noRetry != nil || newBulkRequest != nil {
+		t.Fatalf("all-or-nothing failure should not report per-event retry info, got %v %v %v", shouldRetry, noRetry, newBulkRequest)
+	}
+}
+
+func TestTryOneBulkStreamPerEventRetry(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(`{"errors":true}`))
+	}))
+	defer server.Close()
+
+	p := newTestStreamProcessor(false)
+	sbr := &testStreamBulkRequest{data: []byte(`{"index":{}}` + "\n")}
+
+	success, shouldRetry, noRetry, newBulkRequest := p.tryOneBulkStream(server.URL, sbr, sbr)
+	if !success {
+		t.Fatalf("expected success (HTTP-level) so getRetryEventsFunc gets to inspect the body)")
+	}
+	if len(shouldRetry) != 1 || shouldRetry[0] != 1 {
+		t.Fatalf("shouldRetry = %v, want [1] (from getRetryEventsFunc)", shouldRetry)
+	}
+	if len(noRetry) != 1 || noRetry[0] != 2 {
+		t.Fatalf("noRetry = %v, want [2] (from getRetryEventsFunc)", noRetry)
+	}
+	if newBulkRequest == nil {
+		t.Fatalf("expected the newBulkRequest returned by getRetryEventsFunc")
+	}
+}
+
+func TestTryOneBulkStreamWriteToErrorMidStream(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	p := newTestStreamProcessor(true)
+	sbr := &testStreamBulkRequest{
+		data:     []byte(`{"index":{}}` + "\n" + `{"field":"value"}` + "\n"),
+		writeErr: io.ErrClosedPipe,
+	}
+
+	success, shouldRetry, noRetry, newBulkRequest := p.tryOneBulkStream(server.URL, sbr, sbr)
+	if success {
+		t.Fatalf("expected failure when WriteTo errors mid-stream")
+	}
+	if shouldRetry != nil || noRetry != nil || newBulkRequest != nil {
+		t.Fatalf("a WriteTo error should not report per-event retry info, got %v %v %v", shouldRetry, noRetry, newBulkRequest)
+	}
+}
+
+func TestTryOneBulkStreamCompressed(t *testing.T) {
+	var received []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gr, err := gzip.NewReader(r.Body)
+		if err != nil {
+			t.Errorf("server gzip reader: %s", err)
+			return
+		}
+		received, err = ioutil.ReadAll(gr)
+		if err != nil {
+			t.Errorf("server read gzip body: %s", err)
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	p := newTestStreamProcessor(true)
+	p.compress = true
+	sbr := &testStreamBulkRequest{data: []byte(`{"index":{}}` + "\n")}
+
+	success, _, _, _ := p.tryOneBulkStream(server.URL, sbr, sbr)
+	if !success {
+		t.Fatalf("expected success")
+	}
+	if string(received) != string(sbr.data) {
+		t.Fatalf("server received %q after gunzip, want %q", received, sbr.data)
+	}
+}
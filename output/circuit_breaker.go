@@ -0,0 +1,183 @@
+package output
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	DEFAULT_CB_WINDOW_SIZE       = 20
+	DEFAULT_CB_FAILURE_THRESHOLD = 0.5
+	DEFAULT_CB_COOLDOWN          = 30 * time.Second
+
+	// DEFAULT_CB_MIN_SAMPLES is the fewest outcomes a closed breaker needs
+	// before failureRatio is trusted to open it. Without this, a single
+	// RecordFailure on a brand-new host (filled=1, ratio=1) would trip the
+	// breaker off one transient error. The window is not cleared when a
+	// half-open probe re-closes the breaker, so a just-recovered host is
+	// judged on its last windowSize outcomes, failures before the open
+	// included.
+	DEFAULT_CB_MIN_SAMPLES = 5
+)
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+// hostBreaker tracks a sliding window of the last N outcomes for one host.
+type hostBreaker struct {
+	window  []bool // true == success
+	pos     int
+	filled  int
+	state   breakerState
+	openAt  time.Time
+	probing bool
+}
+
+func (b *hostBreaker) record(success bool) {
+	b.window[b.pos] = success
+	b.pos = (b.pos + 1) % len(b.window)
+	if b.filled < len(b.window) {
+		b.filled++
+	}
+}
+
+func (b *hostBreaker) failureRatio() float64 {
+	if b.filled == 0 {
+		return 0
+	}
+	failures := 0
+	for i := 0; i < b.filled; i++ {
+		if !b.window[i] {
+			failures++
+		}
+	}
+	return float64(failures) / float64(b.filled)
+}
+
+// CircuitBreaker is a per-host failure tracker shared by HostSelector
+// implementations. It is independent of a host's selection weight: a host
+// can still have weight for round-robin purposes while its breaker is open
+// because its last requests mostly failed.
+type CircuitBreaker struct {
+	mux              sync.Mutex
+	breakers         map[string]*hostBreaker
+	windowSize       int
+	minSamples       int
+	failureThreshold float64
+	cooldown         time.Duration
+}
+
+func NewCircuitBreaker(hosts []string, failureThreshold float64, cooldown time.Duration) *CircuitBreaker {
+	if failureThreshold <= 0 {
+		failureThreshold = DEFAULT_CB_FAILURE_THRESHOLD
+	}
+	if cooldown <= 0 {
+		cooldown = DEFAULT_CB_COOLDOWN
+	}
+
+	cb := &CircuitBreaker{
+		breakers:         make(map[string]*hostBreaker),
+		windowSize:       DEFAULT_CB_WINDOW_SIZE,
+		minSamples:       DEFAULT_CB_MIN_SAMPLES,
+		failureThreshold: failureThreshold,
+		cooldown:         cooldown,
+	}
+	for _, host := range hosts {
+		cb.breakers[host] = &hostBreaker{window: make([]bool, cb.windowSize)}
+	}
+
+	return cb
+}
+
+func (c *CircuitBreaker) get(host string) *hostBreaker {
+	b, ok := c.breakers[host]
+	if !ok {
+		b = &hostBreaker{window: make([]bool, c.windowSize)}
+		c.breakers[host] = b
+	}
+	return b
+}
+
+// Allow reports whether host may be selected right now: always true while
+// closed, false while open and still cooling down, and true exactly once per
+// cooldown window while half-open (the single probe request).
+func (c *CircuitBreaker) Allow(host string) bool {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	b := c.get(host)
+	switch b.state {
+	case breakerOpen:
+		if time.Now().Before(b.openAt.Add(c.cooldown)) {
+			return false
+		}
+		b.state = breakerHalfOpen
+		b.probing = false
+		fallthrough
+	case breakerHalfOpen:
+		if b.probing {
+			return false
+		}
+		b.probing = true
+		return true
+	default:
+		return true
+	}
+}
+
+func (c *CircuitBreaker) RecordSuccess(host string) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	b := c.get(host)
+	b.record(true)
+	if b.state == breakerHalfOpen {
+		b.state = breakerClosed
+	}
+	b.probing = false
+}
+
+func (c *CircuitBreaker) RecordFailure(host string) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	b := c.get(host)
+	b.record(false)
+	b.probing = false
+
+	if b.state == breakerHalfOpen || (b.state == breakerClosed && b.filled >= c.minSamples && b.failureRatio() >= c.failureThreshold) {
+		b.state = breakerOpen
+		b.openAt = time.Now()
+	}
+}
+
+// MinCooldownRemaining returns how long until the first currently-open
+// breaker becomes eligible for a half-open probe, or 0 if none are open.
+func (c *CircuitBreaker) MinCooldownRemaining() time.Duration {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	var min time.Duration = -1
+	now := time.Now()
+	for _, b := range c.breakers {
+		if b.state != breakerOpen {
+			continue
+		}
+		remaining := b.openAt.Add(c.cooldown).Sub(now)
+		if remaining < 0 {
+			remaining = 0
+		}
+		if min < 0 || remaining < min {
+			min = remaining
+		}
+	}
+	if min < 0 {
+		return 0
+	}
+	return min
+}
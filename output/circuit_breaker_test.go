@@ -0,0 +1,94 @@
+package output
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCircuitBreakerOpensOnFailureRatio(t *testing.T) {
+	cb := NewCircuitBreaker([]string{"h1"}, 0.5, time.Minute)
+
+	for i := 0; i < 10; i++ {
+		cb.RecordSuccess("h1")
+	}
+	if !cb.Allow("h1") {
+		t.Fatalf("breaker should stay closed while all-success")
+	}
+
+	for i := 0; i < 10; i++ {
+		cb.RecordFailure("h1")
+	}
+	if cb.Allow("h1") {
+		t.Fatalf("breaker should open once failure ratio crosses the threshold")
+	}
+}
+
+func TestCircuitBreakerIgnoresSingleFailureOnFreshHost(t *testing.T) {
+	cb := NewCircuitBreaker([]string{"h1"}, 0.5, time.Minute)
+
+	cb.RecordFailure("h1")
+	if !cb.Allow("h1") {
+		t.Fatalf("a single failure on a fresh host should not trip the breaker before minSamples is reached")
+	}
+}
+
+func TestCircuitBreakerHalfOpenProbe(t *testing.T) {
+	cooldown := 20 * time.Millisecond
+	cb := NewCircuitBreaker([]string{"h1"}, 0.5, cooldown)
+
+	for i := 0; i < DEFAULT_CB_WINDOW_SIZE; i++ {
+		cb.RecordFailure("h1")
+	}
+	if cb.Allow("h1") {
+		t.Fatalf("breaker should be open right after tripping")
+	}
+
+	time.Sleep(cooldown + 5*time.Millisecond)
+
+	if !cb.Allow("h1") {
+		t.Fatalf("breaker should allow exactly one half-open probe after cooldown")
+	}
+	if cb.Allow("h1") {
+		t.Fatalf("breaker should not allow a second concurrent probe while half-open")
+	}
+}
+
+func TestCircuitBreakerClosesAfterSuccessfulProbe(t *testing.T) {
+	cooldown := 20 * time.Millisecond
+	cb := NewCircuitBreaker([]string{"h1"}, 0.5, cooldown)
+
+	for i := 0; i < DEFAULT_CB_WINDOW_SIZE; i++ {
+		cb.RecordFailure("h1")
+	}
+
+	time.Sleep(cooldown + 5*time.Millisecond)
+
+	if !cb.Allow("h1") {
+		t.Fatalf("expected the half-open probe to be allowed")
+	}
+	cb.RecordSuccess("h1")
+
+	if !cb.Allow("h1") {
+		t.Fatalf("breaker should be closed again after a successful probe")
+	}
+}
+
+func TestCircuitBreakerReopensAfterFailedProbe(t *testing.T) {
+	cooldown := 20 * time.Millisecond
+	cb := NewCircuitBreaker([]string{"h1"}, 0.5, cooldown)
+
+	for i := 0; i < DEFAULT_CB_WINDOW_SIZE; i++ {
+		cb.RecordFailure("h1")
+	}
+
+	time.Sleep(cooldown + 5*time.Millisecond)
+
+	if !cb.Allow("h1") {
+		t.Fatalf("expected the half-open probe to be allowed")
+	}
+	cb.RecordFailure("h1")
+
+	if cb.Allow("h1") {
+		t.Fatalf("breaker should reopen after the probe itself fails")
+	}
+}
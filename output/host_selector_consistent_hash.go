@@ -0,0 +1,136 @@
+package output
+
+import (
+	"hash/crc32"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const DEFAULT_VIRTUAL_NODE_COUNT = 150
+
+// ConsistentHashSelector routes a BulkRequest to a host based on a hash of an
+// optional routing key, so that requests sharing a key (e.g. the same index
+// or tenant) consistently land on the same backend. With an empty key it
+// falls back to round-robin over the currently live hosts, so existing call
+// sites that never supply a key keep working unchanged.
+type ConsistentHashSelector struct {
+	hosts            []string
+	virtualNodeCount int
+
+	mux         sync.Mutex
+	positions   []uint32
+	ring        map[uint32]string
+	nodesByHost map[string][]uint32
+
+	rr *RRHostSelector
+	cb *CircuitBreaker
+}
+
+func NewConsistentHashSelector(hosts []string, virtualNodeCount int, cbFailureThreshold float64, cbCooldown time.Duration) *ConsistentHashSelector {
+	if virtualNodeCount <= 0 {
+		virtualNodeCount = DEFAULT_VIRTUAL_NODE_COUNT
+	}
+
+	rr := NewRRHostSelector(hosts, 3, cbFailureThreshold, cbCooldown)
+	s := &ConsistentHashSelector{
+		hosts:            hosts,
+		virtualNodeCount: virtualNodeCount,
+		ring:             make(map[uint32]string),
+		nodesByHost:      make(map[string][]uint32),
+		rr:               rr,
+		cb:               rr.cb,
+	}
+
+	for _, host := range hosts {
+		s.insertHost(host)
+	}
+
+	return s
+}
+
+func (s *ConsistentHashSelector) virtualNodeHash(host string, replica int) uint32 {
+	return crc32.ChecksumIEEE([]byte(host + "#" + strconv.Itoa(replica)))
+}
+
+// insertHost adds all virtual nodes for host to the ring. Caller must hold s.mux.
+func (s *ConsistentHashSelector) insertHost(host string) {
+	positions := make([]uint32, 0, s.virtualNodeCount)
+	for i := 0; i < s.virtualNodeCount; i++ {
+		pos := s.virtualNodeHash(host, i)
+		s.ring[pos] = host
+		positions = append(positions, pos)
+	}
+	s.nodesByHost[host] = positions
+	s.rebuildPositions()
+}
+
+// rebuildPositions regenerates the sorted position slice used by sort.Search.
+// Caller must hold s.mux.
+func (s *ConsistentHashSelector) rebuildPositions() {
+	positions := make([]uint32, 0, len(s.ring))
+	for pos := range s.ring {
+		positions = append(positions, pos)
+	}
+	sort.Slice(positions, func(i, j int) bool { return positions[i] < positions[j] })
+	s.positions = positions
+}
+
+func (s *ConsistentHashSelector) selectOneHost(key string) string {
+	if key == "" {
+		return s.rr.selectOneHost(key)
+	}
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	if len(s.positions) == 0 {
+		return ""
+	}
+
+	hash := crc32.ChecksumIEEE([]byte(key))
+	start := sort.Search(len(s.positions), func(i int) bool { return s.positions[i] >= hash })
+	if start == len(s.positions) {
+		start = 0
+	}
+
+	for i := 0; i < len(s.positions); i++ {
+		idx := (start + i) % len(s.positions)
+		host := s.ring[s.positions[idx]]
+		if s.cb.Allow(host) {
+			return host
+		}
+	}
+
+	return ""
+}
+
+func (s *ConsistentHashSelector) markFailure(host string, err error) {
+	s.cb.RecordFailure(host)
+}
+
+func (s *ConsistentHashSelector) markSuccess(host string) {
+	s.cb.RecordSuccess(host)
+}
+
+func (s *ConsistentHashSelector) minCooldownRemaining() time.Duration {
+	return s.cb.MinCooldownRemaining()
+}
+
+func (s *ConsistentHashSelector) isUp(host string) bool {
+	return s.rr.isUp(host)
+}
+
+// reduceWeight/addWeight only need to keep the rr fallback's weights in sync:
+// ring membership is permanent, and a failing host is kept out of
+// selectOneHost's results by cb.Allow (the same open/half-open breaker state
+// RRHostSelector gates on), so it can earn its way back in via a half-open
+// probe instead of needing a selection it can no longer receive.
+func (s *ConsistentHashSelector) reduceWeight(host string) {
+	s.rr.reduceWeight(host)
+}
+
+func (s *ConsistentHashSelector) addWeight(host string) {
+	s.rr.addWeight(host)
+}
@@ -0,0 +1,488 @@
+// Package wal implements a segmented, length-prefixed append-only log used
+// by output.HTTPBulkProcessor to make buffered-but-not-yet-bulked events
+// durable across a crash or kill. Events are appended as they are added to
+// the in-memory BulkRequest and acked once the bulk they travelled in is
+// accepted downstream; a segment is only deleted once every record in it has
+// been acked.
+package wal
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+type FsyncPolicy string
+
+const (
+	FsyncAlways   FsyncPolicy = "always"
+	FsyncInterval FsyncPolicy = "interval"
+	FsyncNever    FsyncPolicy = "never"
+
+	DEFAULT_MAX_SEGMENT_SIZE  = 128 * 1024 * 1024
+	DEFAULT_FSYNC_INTERVAL_MS = 1000
+	segmentFilePrefix         = "segment-"
+	segmentFileSuffix         = ".wal"
+	ackFileSuffix             = ".ack"
+)
+
+// ParseFsyncPolicy maps the wal.fsync config string to a FsyncPolicy,
+// defaulting to the safe-but-slow FsyncAlways for anything unrecognized.
+func ParseFsyncPolicy(s string) FsyncPolicy {
+	switch FsyncPolicy(s) {
+	case FsyncInterval:
+		return FsyncInterval
+	case FsyncNever:
+		return FsyncNever
+	default:
+		return FsyncAlways
+	}
+}
+
+// Record identifies the position of one appended event, so it can be handed
+// back to Ack once the bulk it shipped in is durably accepted.
+type Record struct {
+	SegmentID int64
+	Index     int64
+}
+
+type segment struct {
+	id      int64
+	path    string
+	ackPath string
+	file    *os.File
+	ackFile *os.File
+	size    int64
+	records int64
+	acked   int64
+	sealed  bool
+
+	// recordSizes[i] is the on-disk byte footprint (4-byte length prefix +
+	// data) of record i, and ackedFlags[i] says whether it has already been
+	// acked, so unackedBytes can track the true outstanding byte count
+	// instead of the whole segment's size.
+	recordSizes  []int64
+	ackedFlags   []bool
+	unackedBytes int64
+}
+
+// WAL is a segmented append-only log rooted at a directory. Segments rotate
+// at maxSize; a segment is removed once every record appended to it has been
+// acked.
+type WAL struct {
+	dir     string
+	maxSize int64
+	fsync   FsyncPolicy
+
+	mux      sync.Mutex
+	current  *segment
+	segments map[int64]*segment
+	nextID   int64
+}
+
+// Open scans dir for existing segments (treating all of them as sealed, so
+// a crash-recovered WAL can be fully replayed). No current segment is opened
+// here; the first Append opens a fresh one.
+func Open(dir string, maxSize int64, fsync FsyncPolicy, fsyncInterval time.Duration) (*WAL, error) {
+	if maxSize <= 0 {
+		maxSize = DEFAULT_MAX_SEGMENT_SIZE
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("create wal dir %s: %w", dir, err)
+	}
+
+	w := &WAL{
+		dir:      dir,
+		maxSize:  maxSize,
+		fsync:    fsync,
+		segments: make(map[int64]*segment),
+	}
+
+	if err := w.loadExistingSegments(); err != nil {
+		return nil, err
+	}
+
+	if fsync == FsyncInterval {
+		if fsyncInterval <= 0 {
+			fsyncInterval = DEFAULT_FSYNC_INTERVAL_MS * time.Millisecond
+		}
+		go w.syncLoop(fsyncInterval)
+	}
+
+	return w, nil
+}
+
+func (w *WAL) syncLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	for range ticker.C {
+		w.mux.Lock()
+		if w.current != nil {
+			w.current.file.Sync()
+			w.current.ackFile.Sync()
+		}
+		w.mux.Unlock()
+	}
+}
+
+func (w *WAL) loadExistingSegments() error {
+	entries, err := os.ReadDir(w.dir)
+	if err != nil {
+		return err
+	}
+
+	var maxID int64 = -1
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !strings.HasPrefix(name, segmentFilePrefix) || !strings.HasSuffix(name, segmentFileSuffix) {
+			continue
+		}
+		idStr := strings.TrimSuffix(strings.TrimPrefix(name, segmentFilePrefix), segmentFileSuffix)
+		id, err := strconv.ParseInt(idStr, 10, 64)
+		if err != nil {
+			continue
+		}
+
+		seg, err := w.openSegment(id, true)
+		if err != nil {
+			return err
+		}
+		w.segments[id] = seg
+		if id > maxID {
+			maxID = id
+		}
+	}
+
+	w.nextID = maxID + 1
+	return nil
+}
+
+func (w *WAL) segmentPaths(id int64) (string, string) {
+	path := filepath.Join(w.dir, fmt.Sprintf("%s%d%s", segmentFilePrefix, id, segmentFileSuffix))
+	return path, path + ackFileSuffix
+}
+
+func (w *WAL) openSegment(id int64, sealed bool) (*segment, error) {
+	path, ackPath := w.segmentPaths(id)
+
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("open wal segment %s: %w", path, err)
+	}
+	ackFile, err := os.OpenFile(ackPath, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("open wal ack file %s: %w", ackPath, err)
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		ackFile.Close()
+		return nil, err
+	}
+
+	acked, err := loadAckedSet(ackPath)
+	if err != nil {
+		file.Close()
+		ackFile.Close()
+		return nil, err
+	}
+
+	sizes, err := loadRecordSizes(path)
+	if err != nil {
+		file.Close()
+		ackFile.Close()
+		return nil, err
+	}
+
+	ackedFlags := make([]bool, len(sizes))
+	var unackedBytes int64
+	for i, sz := range sizes {
+		if acked[int64(i)] {
+			ackedFlags[i] = true
+		} else {
+			unackedBytes += sz
+		}
+	}
+
+	seg := &segment{
+		id:           id,
+		path:         path,
+		ackPath:      ackPath,
+		file:         file,
+		ackFile:      ackFile,
+		size:         info.Size(),
+		records:      int64(len(sizes)),
+		acked:        int64(len(acked)),
+		sealed:       sealed,
+		recordSizes:  sizes,
+		ackedFlags:   ackedFlags,
+		unackedBytes: unackedBytes,
+	}
+
+	return seg, nil
+}
+
+// loadRecordSizes reads path's length-prefixed records and returns each
+// one's on-disk byte footprint (4-byte length prefix + data), in order.
+func loadRecordSizes(path string) ([]int64, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var sizes []int64
+	r := bufio.NewReader(f)
+	for {
+		var lenBuf [4]byte
+		if _, err := io.ReadFull(r, lenBuf[:]); err != nil {
+			break
+		}
+		length := binary.BigEndian.Uint32(lenBuf[:])
+		if _, err := io.CopyN(io.Discard, r, int64(length)); err != nil {
+			break
+		}
+		sizes = append(sizes, int64(4+length))
+	}
+	return sizes, nil
+}
+
+func loadAckedSet(ackPath string) (map[int64]bool, error) {
+	acked := make(map[int64]bool)
+
+	f, err := os.Open(ackPath)
+	if os.IsNotExist(err) {
+		return acked, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	for {
+		var idxBuf [8]byte
+		if _, err := io.ReadFull(r, idxBuf[:]); err != nil {
+			break
+		}
+		acked[int64(binary.BigEndian.Uint64(idxBuf[:]))] = true
+	}
+
+	return acked, nil
+}
+
+// Append writes data as a new length-prefixed record to the current segment,
+// rotating to a fresh segment first if the current one is full.
+func (w *WAL) Append(data []byte) (Record, error) {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+
+	if w.current == nil || w.current.size >= w.maxSize {
+		if err := w.rotateLocked(); err != nil {
+			return Record{}, err
+		}
+	}
+
+	seg := w.current
+
+	var lenBuf [4]byte
+	binary.BigEndian.PutUint32(lenBuf[:], uint32(len(data)))
+	if _, err := seg.file.Write(lenBuf[:]); err != nil {
+		return Record{}, fmt.Errorf("wal append: %w", err)
+	}
+	if _, err := seg.file.Write(data); err != nil {
+		return Record{}, fmt.Errorf("wal append: %w", err)
+	}
+
+	if w.fsync == FsyncAlways {
+		if err := seg.file.Sync(); err != nil {
+			return Record{}, fmt.Errorf("wal sync: %w", err)
+		}
+	}
+
+	rec := Record{SegmentID: seg.id, Index: seg.records}
+	recBytes := int64(4 + len(data))
+	seg.size += recBytes
+	seg.records++
+	seg.recordSizes = append(seg.recordSizes, recBytes)
+	seg.ackedFlags = append(seg.ackedFlags, false)
+	seg.unackedBytes += recBytes
+
+	return rec, nil
+}
+
+func (w *WAL) rotateLocked() error {
+	if w.current != nil {
+		w.current.sealed = true
+		// Its records may all have been acked before it filled up, in which
+		// case no later Ack will look at it again.
+		if w.current.acked >= w.current.records {
+			w.removeSegmentLocked(w.current)
+		}
+	}
+
+	seg, err := w.openSegment(w.nextID, false)
+	if err != nil {
+		return err
+	}
+	w.nextID++
+
+	w.segments[seg.id] = seg
+	w.current = seg
+
+	return nil
+}
+
+// Ack marks records as durably delivered. Once every record in a sealed
+// segment has been acked, the segment (and its ack file) is deleted.
+func (w *WAL) Ack(records []Record) error {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+
+	for _, rec := range records {
+		seg, ok := w.segments[rec.SegmentID]
+		if !ok {
+			continue
+		}
+		if rec.Index < 0 || rec.Index >= int64(len(seg.ackedFlags)) || seg.ackedFlags[rec.Index] {
+			continue
+		}
+
+		var idxBuf [8]byte
+		binary.BigEndian.PutUint64(idxBuf[:], uint64(rec.Index))
+		if _, err := seg.ackFile.Write(idxBuf[:]); err != nil {
+			return fmt.Errorf("wal ack: %w", err)
+		}
+		if w.fsync == FsyncAlways {
+			if err := seg.ackFile.Sync(); err != nil {
+				return fmt.Errorf("wal ack sync: %w", err)
+			}
+		}
+		seg.ackedFlags[rec.Index] = true
+		seg.unackedBytes -= seg.recordSizes[rec.Index]
+		seg.acked++
+
+		if seg.sealed && seg.acked >= seg.records {
+			w.removeSegmentLocked(seg)
+		}
+	}
+
+	return nil
+}
+
+func (w *WAL) removeSegmentLocked(seg *segment) {
+	seg.file.Close()
+	seg.ackFile.Close()
+	if err := os.Remove(seg.path); err != nil && !os.IsNotExist(err) {
+		glog.Errorf("remove wal segment %s: %s", seg.path, err)
+	}
+	if err := os.Remove(seg.ackPath); err != nil && !os.IsNotExist(err) {
+		glog.Errorf("remove wal ack file %s: %s", seg.ackPath, err)
+	}
+	delete(w.segments, seg.id)
+}
+
+// Replay feeds every unacked record, oldest segment first, through fn.
+// Callers use this at startup to re-add events lost when the process died
+// between add() and a successful bulk().
+func (w *WAL) Replay(fn func([]byte) error) error {
+	w.mux.Lock()
+	ids := make([]int64, 0, len(w.segments))
+	for id := range w.segments {
+		ids = append(ids, id)
+	}
+	w.mux.Unlock()
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	for _, id := range ids {
+		w.mux.Lock()
+		seg := w.segments[id]
+		w.mux.Unlock()
+		if seg == nil {
+			continue
+		}
+		if err := w.replaySegment(seg, fn); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (w *WAL) replaySegment(seg *segment, fn func([]byte) error) error {
+	acked, err := loadAckedSet(seg.ackPath)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(seg.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	var index int64
+	for {
+		var lenBuf [4]byte
+		if _, err := io.ReadFull(r, lenBuf[:]); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return fmt.Errorf("replay wal segment %s: %w", seg.path, err)
+		}
+		length := binary.BigEndian.Uint32(lenBuf[:])
+		data := make([]byte, length)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return fmt.Errorf("replay wal segment %s: %w", seg.path, err)
+		}
+
+		if !acked[index] {
+			if err := fn(data); err != nil {
+				return err
+			}
+		}
+		index++
+	}
+
+	return nil
+}
+
+// UnackedBytes reports how many bytes of still-outstanding records (not
+// whole segments) are waiting on an ack, for operators to alarm on when
+// downstream is lagging.
+func (w *WAL) UnackedBytes() int64 {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+
+	var total int64
+	for _, seg := range w.segments {
+		total += seg.unackedBytes
+	}
+	return total
+}
+
+func (w *WAL) Close() error {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+
+	for _, seg := range w.segments {
+		seg.file.Close()
+		seg.ackFile.Close()
+	}
+	return nil
+}